@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// errSecretsVerificationFailed wraps a failure to decrypt or verify an
+// encrypted or signed secrets file that is actually present, so callers
+// can tell "secrets not configured" (fine to run without) apart from
+// "secrets tampered with or corrupt" (must not be treated the same way).
+var errSecretsVerificationFailed = errors.New("secrets verification failed")
+
+// Secrets holds the named values loaded from secrets.yaml (or one of its
+// signed/encrypted variants). It replaces the single Token field so
+// additional secrets (DO token, SSH key, registry creds) can live in one
+// file.
+type Secrets map[string]string
+
+// Get returns the named secret and whether it was present.
+func (s Secrets) Get(name string) (string, bool) {
+	v, ok := s[name]
+	return v, ok
+}
+
+const (
+	secretsPlain     = "secrets.yaml"
+	secretsEncrypted = "secrets.yaml.sec"
+	secretsSigned    = "secrets.yaml.sig"
+	privateKeyPath   = "keys/private.pem"
+	publicKeyPath    = "keys/public.pem"
+)
+
+// getSecrets loads secrets.yaml, preferring the encrypted or signed variant
+// when present. If a signed or encrypted file exists but fails to verify
+// or decrypt, getSecrets fails closed: it returns an error rather than
+// falling through to a plaintext file.
+func getSecrets() (Secrets, error) {
+	if _, err := os.Stat(secretsEncrypted); err == nil {
+		secrets, err := loadEncryptedSecrets(secretsEncrypted)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errSecretsVerificationFailed, err)
+		}
+		return secrets, nil
+	}
+	if _, err := os.Stat(secretsSigned); err == nil {
+		secrets, err := loadSignedSecrets(secretsSigned)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errSecretsVerificationFailed, err)
+		}
+		return secrets, nil
+	}
+
+	yamlFile, err := os.ReadFile(secretsPlain)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", secretsPlain, err)
+	}
+	return unmarshalSecrets(yamlFile)
+}
+
+func loadEncryptedSecrets(path string) (Secrets, error) {
+	priv, err := loadPrivateKey(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load private key: %w", err)
+	}
+
+	ciphertext, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	jwe, err := jose.ParseEncrypted(string(ciphertext), []jose.KeyAlgorithm{jose.RSA_OAEP, jose.RSA_OAEP_256}, []jose.ContentEncryption{jose.A128GCM, jose.A256GCM})
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	plaintext, err := jwe.Decrypt(priv)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s: %w", path, err)
+	}
+
+	return unmarshalSecrets(plaintext)
+}
+
+func loadSignedSecrets(path string) (Secrets, error) {
+	pub, err := loadPublicKey(publicKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load public key: %w", err)
+	}
+
+	signed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	jws, err := jose.ParseSigned(string(signed), []jose.SignatureAlgorithm{jose.RS256})
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	plaintext, err := jws.Verify(pub)
+	if err != nil {
+		return nil, fmt.Errorf("verify %s: %w", path, err)
+	}
+
+	return unmarshalSecrets(plaintext)
+}
+
+func unmarshalSecrets(b []byte) (Secrets, error) {
+	secrets := Secrets{}
+	if err := yaml.Unmarshal(b, &secrets); err != nil {
+		return nil, fmt.Errorf("unmarshal secrets: %w", err)
+	}
+	return secrets, nil
+}
+
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		k, err2 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err2 != nil {
+			return nil, err
+		}
+		rsaKey, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an RSA private key", path)
+		}
+		return rsaKey, nil
+	}
+	return key, nil
+}
+
+func loadPublicKey(path string) (*rsa.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", path)
+	}
+	return rsaKey, nil
+}
@@ -1,127 +1,90 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"time"
 
-	"github.com/creack/pty"
-	"gopkg.in/yaml.v3"
+	"github.com/digitalocean/godo"
+
+	"kiwi/worker/pool"
+	"kiwi/worker/store"
 )
 
-type Secrets struct {
-	Token string
-}
+// sessionIdleGraceEnv names the environment variable that configures how
+// long an idle session (no subscribers) is kept alive before it's torn
+// down, as a Go duration string like "5m".
+const sessionIdleGraceEnv = "KIWI_SESSION_IDLE_GRACE"
 
 func main() {
+	sessions := newSessionManager(sessionIdleGrace())
+
+	http.HandleFunc("POST /sessions", sessions.createSessionHandler)
+	http.HandleFunc("DELETE /sessions/{id}", sessions.deleteSessionHandler)
+	http.HandleFunc("POST /sessions/{id}/input", sessions.inputHandler)
+	http.HandleFunc("POST /sessions/{id}/resize", sessions.resizeHandler)
+	http.HandleFunc("/sessions/{id}/ws", sessions.wsHandler)
+	http.HandleFunc("/events/{id}", sessions.eventsHandler)
+
+	if worker, err := setupWorkerAPI(sessions); err != nil {
+		if errors.Is(err, errSecretsVerificationFailed) {
+			log.Fatalf("refusing to start: %v", err)
+		}
+		log.Printf("worker pool disabled: %v", err)
+	} else {
+		// /tunnel is only registered once a worker pool exists to verify
+		// tunnel tokens against; with no pool there are no workers that
+		// could authenticate anyway.
+		http.HandleFunc("/tunnel", tunnelHandler(worker.verifyWorkerToken))
+		http.HandleFunc("/workers", worker.workersHandler)
+		http.HandleFunc("DELETE /workers/{id}", worker.workerHandler)
+		http.HandleFunc("POST /jobs", worker.jobsHandler)
+		go worker.RunScheduler(5*time.Second, nil)
+	}
 
-	http.HandleFunc("/events", eventsHandler)
 	http.Handle("/", http.FileServer(http.Dir("./dist")))
 	http.ListenAndServe(":3000", nil)
-	// 	_, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
-	// 	if err != nil {
-	// 		panic("failed to connect database")
-	// 	}
-	// 	secrets := getSecrets()
-	// 	client := godo.NewFromToken(secrets.Token)
-	// 	list, _, err := client.Droplets.List(context.TODO(), &godo.ListOptions{})
-
-	// 	for _, drop := range list {
-	// 		fmt.Println(drop.Name, drop.Tags, drop.ID)
-	// 	}
-
-	// _, _, err = client.Droplets.Create(context.TODO(), &godo.DropletCreateRequest{
-	// 	Name:   "kiwi-worker-test",
-	// 	Region: "nyc3",
-	// 	Size:   "s-2vcpu-4gb",
-	// 	Image: godo.DropletCreateImage{
-	// 		ID:   0,
-	// 		Slug: "ubuntu-20-04-x64",
-	// 	},
-	// 	SSHKeys:           []godo.DropletCreateSSHKey{},
-	// 	Backups:           false,
-	// 	IPv6:              true,
-	// 	PrivateNetworking: false,
-	// 	Monitoring:        false,
-	// 	UserData:          "",
-	// 	Volumes:           []godo.DropletCreateVolume{},
-	// 	Tags:              []string{"env:test", "kiwi", "worker"},
-	// 	VPCUUID:           "",
-	// 	WithDropletAgent:  new(bool),
-	// })
-	// fmt.Printf("%v, %v, %v", list, resp, err)
-
-	// client.Droplets.Delete(context.TODO(), 407293232)
 }
 
-func eventsHandler(w http.ResponseWriter, r *http.Request) {
-	println("accepted events connection")
-
-	// Set CORS headers to allow all origins. You may want to restrict this to specific origins in a production environment.
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Type")
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	// cmd := exec.Command("top")
-
-	// stderr, _ := cmd.StderrPipe()
-	// cmd.Start()
-
-	// scanner := bufio.NewScanner(stderr)
-	// scanner.Split(bufio.ScanWords)
-	// for scanner.Scan() {
-	// 	m := scanner.Text()
-	// 	println(m)
-	// 	fmt.Fprintf(w, "data: %s\n\n", m)
-	// 	w.(http.Flusher).Flush()
-	// 	time.Sleep(1 * time.Second)
-	// }
-
-	// might just want to do std out to start, ping doesn't work with tty
-	c := exec.Command("top")
-
-	f, err := pty.Start(c)
-	// pty.Setsize(f, &pty.Winsize{})
-	if err != nil {
-		panic(err)
+// sessionIdleGrace reads the configured idle grace period from
+// KIWI_SESSION_IDLE_GRACE, falling back to defaultIdleGrace if it's unset
+// or unparseable.
+func sessionIdleGrace() time.Duration {
+	v := os.Getenv(sessionIdleGraceEnv)
+	if v == "" {
+		return defaultIdleGrace
 	}
 
-	// get inheret size working: https://github.com/creack/pty
-
-	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanRunes)
-	for scanner.Scan() {
-		m := scanner.Text()
-		fmt.Fprintf(w, "data: %s\n\n", m)
-		w.(http.Flusher).Flush()
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using default %s", sessionIdleGraceEnv, v, defaultIdleGrace)
+		return defaultIdleGrace
 	}
-
-	// io.Copy(w, f)
-
-	// cmd.Wait()
-
-	// Simulate closing the connection
-	closeNotify := w.(http.CloseNotifier).CloseNotify()
-	<-closeNotify
+	return d
 }
 
-func getSecrets() Secrets {
-
-	secrets := Secrets{}
-	yamlFile, err := os.ReadFile("secrets.yaml")
+// setupWorkerAPI wires together the secrets-derived DO client, the job/
+// worker database and the WorkerAPI. It returns an error rather than
+// panicking so a missing DO token just disables the worker endpoints.
+func setupWorkerAPI(sessions *SessionManager) (*WorkerAPI, error) {
+	secrets, err := getSecrets()
 	if err != nil {
-		log.Printf("yamlFile.Get err   #%v ", err)
+		return nil, err
 	}
-	err = yaml.Unmarshal(yamlFile, &secrets)
+
+	token, ok := secrets.Get("do_token")
+	if !ok {
+		return nil, fmt.Errorf("do_token not set in secrets")
+	}
+
+	db, err := store.Open("test.db")
 	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+		return nil, err
 	}
 
-	return secrets
+	client := godo.NewFromToken(token)
+	return newWorkerAPI(pool.New(client, db), db, sessions), nil
 }
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/creack/pty"
+
+	"kiwi/workerconn"
+)
+
+// backlogSize is how many bytes of prior output a late-joining subscriber
+// gets replayed before switching to live writes.
+const backlogSize = 64 * 1024
+
+// defaultIdleGrace is how long a session is kept alive with zero
+// subscribers before it is torn down, when the caller doesn't configure
+// one explicitly.
+const defaultIdleGrace = 5 * time.Minute
+
+// Session wraps a single running process, local or on a tunnelled worker,
+// fanning its output out to any number of subscribers.
+type Session struct {
+	ID  string
+	cmd *exec.Cmd // nil for sessions running on a remote worker
+	pty *os.File  // nil for sessions running on a remote worker
+	rw  io.ReadWriteCloser
+
+	idleGrace time.Duration
+
+	mu          sync.Mutex
+	backlog     []byte
+	subscribers map[chan []byte]struct{}
+	refCount    int
+	idleTimer   *time.Timer
+	closed      bool
+}
+
+// newSession starts cmd under a pty and begins fanning its output out to
+// subscribers. The caller is responsible for registering the session with
+// a SessionManager.
+func newSession(id string, cmd *exec.Cmd, idleGrace time.Duration) (*Session, error) {
+	f, err := pty.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		ID:          id,
+		cmd:         cmd,
+		pty:         f,
+		rw:          f,
+		idleGrace:   idleGrace,
+		subscribers: make(map[chan []byte]struct{}),
+	}
+
+	go s.pump()
+
+	return s, nil
+}
+
+// newRemoteSession opens an exec stream to workerID over the reverse
+// tunnel and fans its output out the same way a local pty session does,
+// so callers can't tell the difference from the SessionManager API.
+func newRemoteSession(id, workerID string, idleGrace time.Duration) (*Session, error) {
+	conn, err := workerconn.Exec(workerID)
+	if err != nil {
+		return nil, fmt.Errorf("exec on worker %s: %w", workerID, err)
+	}
+
+	s := &Session{
+		ID:          id,
+		rw:          conn,
+		idleGrace:   idleGrace,
+		subscribers: make(map[chan []byte]struct{}),
+	}
+
+	go s.pump()
+
+	return s, nil
+}
+
+// pump reads the session's output and fans it out to subscribers. It is
+// the only goroutine that ever reads from s.rw, so subscribers never
+// contend with each other for the underlying fd.
+func (s *Session) pump() {
+	scanner := bufio.NewScanner(s.rw)
+	scanner.Split(bufio.ScanRunes)
+	for scanner.Scan() {
+		s.broadcast([]byte(scanner.Text()))
+	}
+	s.Close()
+}
+
+func (s *Session) broadcast(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.backlog = append(s.backlog, b...)
+	if len(s.backlog) > backlogSize {
+		s.backlog = s.backlog[len(s.backlog)-backlogSize:]
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- b:
+		default:
+			// slow subscriber, drop the frame rather than block the pump
+		}
+	}
+}
+
+// subscribe registers ch to receive live writes and returns the current
+// backlog so a late joiner has context before the first live frame. If
+// the session has already finished and closed by the time the caller
+// subscribes, ch is closed immediately and the full backlog is returned
+// instead of registering it into the (now nil) subscriber set.
+func (s *Session) subscribe(ch chan []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backlog := make([]byte, len(s.backlog))
+	copy(backlog, s.backlog)
+
+	if s.closed {
+		close(ch)
+		return backlog
+	}
+
+	s.subscribers[ch] = struct{}{}
+	s.refCount++
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+
+	return backlog
+}
+
+// unsubscribe removes ch. Once the last subscriber leaves, the session
+// starts its idle grace timer rather than terminating immediately.
+func (s *Session) unsubscribe(ch chan []byte, onIdleExpire func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscribers, ch)
+	s.refCount--
+	s.armIdleTimerLocked(onIdleExpire)
+}
+
+// armIdleTimerLocked starts the idle grace timer if the session currently
+// has no subscribers. s.mu must already be held.
+func (s *Session) armIdleTimerLocked(onIdleExpire func()) {
+	if s.refCount <= 0 && !s.closed {
+		s.idleTimer = time.AfterFunc(s.idleGrace, onIdleExpire)
+	}
+}
+
+// armIdleTimer starts the idle grace timer if the session currently has
+// no subscribers. Called right after creation so a session that never
+// gets a subscriber still gets torn down, not just one that had
+// subscribers and lost them all.
+func (s *Session) armIdleTimer(onIdleExpire func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.armIdleTimerLocked(onIdleExpire)
+}
+
+// WriteInput writes raw bytes to the session, as if typed at the
+// controlling terminal.
+func (s *Session) WriteInput(b []byte) error {
+	_, err := s.rw.Write(b)
+	return err
+}
+
+// Resize sets the pty window size. Remote sessions don't have a local
+// pty to resize, so this returns an error for those.
+func (s *Session) Resize(rows, cols uint16) error {
+	if s.pty == nil {
+		return fmt.Errorf("session %s: resize not supported for remote sessions", s.ID)
+	}
+	return pty.Setsize(s.pty, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+// Close terminates the underlying process and pty. Safe to call more than
+// once.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	for ch := range s.subscribers {
+		close(ch)
+	}
+	s.subscribers = nil
+
+	s.rw.Close()
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+	return nil
+}
+
+// SessionManager owns the set of live sessions, keyed by the session ID
+// used in the URL.
+type SessionManager struct {
+	idleGrace time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// newSessionManager returns a SessionManager whose sessions are torn down
+// idleGrace after their last subscriber leaves. A zero or negative value
+// falls back to defaultIdleGrace.
+func newSessionManager(idleGrace time.Duration) *SessionManager {
+	if idleGrace <= 0 {
+		idleGrace = defaultIdleGrace
+	}
+	return &SessionManager{idleGrace: idleGrace, sessions: make(map[string]*Session)}
+}
+
+// Create starts a new session running cmd and registers it under id. The
+// session starts its idle grace timer immediately, so one that never
+// picks up a subscriber is still torn down rather than leaking.
+func (m *SessionManager) Create(id string, cmd *exec.Cmd) (*Session, error) {
+	s, err := newSession(id, cmd, m.idleGrace)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.sessions[id] = s
+	m.mu.Unlock()
+
+	s.armIdleTimer(func() { m.Terminate(id) })
+
+	return s, nil
+}
+
+// CreateRemote starts a new session running on the given tunnelled
+// worker, rather than as a local process, and registers it under id. As
+// with Create, its idle grace timer starts immediately.
+func (m *SessionManager) CreateRemote(id, workerID string) (*Session, error) {
+	s, err := newRemoteSession(id, workerID, m.idleGrace)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.sessions[id] = s
+	m.mu.Unlock()
+
+	s.armIdleTimer(func() { m.Terminate(id) })
+
+	return s, nil
+}
+
+// Get returns the session registered under id, if any.
+func (m *SessionManager) Get(id string) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+// Terminate closes and unregisters the session with the given id.
+func (m *SessionManager) Terminate(id string) bool {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	if ok {
+		delete(m.sessions, id)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	s.Close()
+	return true
+}
+
+func (m *SessionManager) remove(id string) {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+}
+
+// createSessionHandler handles POST /sessions, starting a new session and
+// returning its ID. With a ?worker=<id> query param, the session runs on
+// that tunnelled worker instead of spawning locally.
+func (m *SessionManager) createSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := fmt.Sprintf("%d", time.Now().UnixNano())
+
+	var err error
+	if workerID := r.URL.Query().Get("worker"); workerID != "" {
+		_, err = m.CreateRemote(id, workerID)
+	} else {
+		_, err = m.Create(id, exec.Command("bash"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"id":%q}`, id)
+}
+
+// deleteSessionHandler handles DELETE /sessions/{id}.
+func (m *SessionManager) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !m.Terminate(id) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resizeRequest is the JSON body accepted by resizeHandler.
+type resizeRequest struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// inputHandler handles POST /sessions/{id}/input, writing the request body
+// straight into the session's pty.
+func (m *SessionManager) inputHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := m.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.WriteInput(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resizeHandler handles POST /sessions/{id}/resize with a {rows, cols}
+// JSON body.
+func (m *SessionManager) resizeHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := m.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	var req resizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Resize(req.Rows, req.Cols); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeSSEData writes b as one or more "data: " lines followed by the
+// blank line that terminates an SSE event. A payload with embedded
+// newlines must repeat the "data:" prefix on every line, or a
+// spec-compliant EventSource parses only the first line and silently
+// drops the rest.
+func writeSSEData(w io.Writer, b []byte) {
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// eventsHandler handles SSE subscriptions to an existing session's output,
+// replaying the backlog before switching to live writes.
+func (m *SessionManager) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	s, ok := m.Get(id)
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := make(chan []byte, 256)
+	backlog := s.subscribe(ch)
+	flusher := w.(http.Flusher)
+
+	if len(backlog) > 0 {
+		writeSSEData(w, backlog)
+		flusher.Flush()
+	}
+
+	defer s.unsubscribe(ch, func() { m.Terminate(id) })
+
+	for {
+		select {
+		case b, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeSSEData(w, b)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
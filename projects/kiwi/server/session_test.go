@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionInputEchoesOutput(t *testing.T) {
+	m := newSessionManager(0)
+	s, err := m.Create("test", exec.Command("bash"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer m.Terminate("test")
+
+	ch := make(chan []byte, 256)
+	s.subscribe(ch)
+	defer s.unsubscribe(ch, func() {})
+
+	if err := s.WriteInput([]byte("echo hi\n")); err != nil {
+		t.Fatalf("WriteInput: %v", err)
+	}
+
+	var got strings.Builder
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case b, ok := <-ch:
+			if !ok {
+				t.Fatalf("session closed before seeing expected output, got %q", got.String())
+			}
+			got.Write(b)
+			if strings.Contains(got.String(), "hi") {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for output, got %q", got.String())
+		}
+	}
+}
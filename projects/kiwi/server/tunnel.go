@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"kiwi/workerconn"
+)
+
+// tunnelHandler returns the handler for the /tunnel websocket endpoint
+// that a worker's boot-time agent dials outbound to, so it stays
+// reachable for exec/log streaming even from behind a NAT or firewalled
+// VPC. Once registered, workerconn.Dial can open logical streams to the
+// worker by ID. verify checks the ?token= a worker presents against the
+// one minted for it at create time; Register evicts and replaces
+// whatever tunnel is currently registered for a worker ID, so an
+// unauthenticated caller must never reach it.
+func tunnelHandler(verify func(workerID, token string) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workerID := r.URL.Query().Get("worker")
+		if workerID == "" {
+			http.Error(w, "missing worker query param", http.StatusBadRequest)
+			return
+		}
+
+		if !verify(workerID, r.URL.Query().Get("token")) {
+			http.Error(w, "invalid worker token", http.StatusUnauthorized)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("tunnel upgrade for %s: %v", workerID, err)
+			return
+		}
+
+		if err := workerconn.Register(workerID, &wsConn{conn: conn}); err != nil {
+			log.Printf("register tunnel for %s: %v", workerID, err)
+			conn.Close()
+		}
+	}
+}
+
+// wsConn adapts a *websocket.Conn, which is message-oriented, to the
+// net.Conn stream interface yamux needs to multiplex over it, buffering
+// the current message's reader across Read calls that are too small to
+// drain it in one go.
+type wsConn struct {
+	conn *websocket.Conn
+
+	mu  sync.Mutex
+	cur io.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if c.cur == nil {
+			_, r, err := c.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.cur = r
+		}
+
+		n, err := c.cur.Read(p)
+		if err == io.EOF {
+			c.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error                       { return c.conn.Close() }
+func (c *wsConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *wsConn) SetDeadline(t time.Time) error      { return c.conn.UnderlyingConn().SetDeadline(t) }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.conn.UnderlyingConn().SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.conn.UnderlyingConn().SetWriteDeadline(t) }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+
+	"kiwi/worker/pool"
+	"kiwi/worker/store"
+	"kiwi/workerconn"
+)
+
+// JobSpec is the YAML pipeline document accepted by POST /jobs, analogous
+// to a .drone.yml: a list of steps to run in order.
+type JobSpec struct {
+	Steps []JobStep `yaml:"steps"`
+}
+
+// JobStep is one step of a JobSpec: shell commands to run, with
+// environment variables exported before them. runJob does not use Image;
+// all steps run in one shell on the worker, so a step's Env stays set for
+// the steps after it.
+type JobStep struct {
+	Image    string            `yaml:"image"`
+	Commands []string          `yaml:"commands"`
+	Env      map[string]string `yaml:"env"`
+}
+
+// WorkerAPI exposes the worker pool and job queue over HTTP, and runs the
+// scheduler that assigns queued jobs to idle workers.
+type WorkerAPI struct {
+	pool     *pool.Pool
+	db       *gorm.DB
+	sessions *SessionManager
+}
+
+// newWorkerAPI returns a WorkerAPI backed by p and db, streaming job
+// output through sessions.
+func newWorkerAPI(p *pool.Pool, db *gorm.DB, sessions *SessionManager) *WorkerAPI {
+	return &WorkerAPI{pool: p, db: db, sessions: sessions}
+}
+
+// verifyWorkerToken reports whether token matches the one minted for
+// workerID at droplet-create time. Passed to tunnelHandler to
+// authenticate inbound tunnel registrations.
+func (a *WorkerAPI) verifyWorkerToken(workerID, token string) bool {
+	id, err := strconv.ParseUint(workerID, 10, 64)
+	if err != nil {
+		return false
+	}
+	return a.pool.VerifyToken(uint(id), token)
+}
+
+// createWorkerRequest is the JSON body accepted by POST /workers.
+type createWorkerRequest struct {
+	Region string `json:"region"`
+	Size   string `json:"size"`
+	Image  string `json:"image"`
+	Env    string `json:"env"`
+}
+
+// workersHandler handles GET /workers (optionally filtered by ?tag=) and
+// POST /workers.
+func (a *WorkerAPI) workersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		workers, err := a.pool.List(r.URL.Query().Get("tag"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(workers)
+
+	case http.MethodPost:
+		var req createWorkerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		worker, err := a.pool.Create(r.Context(), pool.CreateRequest{
+			Region: req.Region,
+			Size:   req.Size,
+			Image:  req.Image,
+			Env:    req.Env,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(worker)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// workerHandler handles DELETE /workers/{id}.
+func (a *WorkerAPI) workerHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid worker id", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.pool.Destroy(r.Context(), uint(id)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// jobsHandler handles POST /jobs, queueing the YAML pipeline document in
+// the request body for the scheduler to pick up.
+func (a *WorkerAPI) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var spec JobSpec
+	if err := yaml.Unmarshal(body, &spec); err != nil {
+		http.Error(w, fmt.Sprintf("invalid job spec: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	job := &store.Job{Spec: string(body), Status: "queued"}
+	if err := a.db.Create(job).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(job)
+}
+
+// schedulerTag is the worker tag the scheduler matches queued jobs
+// against. Every pool-managed worker carries it by default.
+const schedulerTag = "worker"
+
+// RunScheduler polls for queued jobs and idle workers every interval,
+// assigning one job to one worker at a time, until stop is closed.
+func (a *WorkerAPI) RunScheduler(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.pool.PollProvisioning(context.Background()); err != nil {
+				log.Printf("poll provisioning workers: %v", err)
+			}
+			a.scheduleOne()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (a *WorkerAPI) scheduleOne() {
+	var job store.Job
+	if err := a.db.Where("status = ?", "queued").First(&job).Error; err != nil {
+		return
+	}
+
+	worker, err := a.pool.Idle(schedulerTag)
+	if err != nil || worker == nil {
+		return
+	}
+
+	a.pool.SetStatus(worker.ID, "busy")
+	a.db.Model(&job).Updates(map[string]any{"status": "running", "worker_id": worker.ID})
+
+	go a.runJob(job, *worker)
+}
+
+func (a *WorkerAPI) runJob(job store.Job, worker store.Worker) {
+	var spec JobSpec
+	if err := yaml.Unmarshal([]byte(job.Spec), &spec); err != nil {
+		a.finishJob(job, worker, "failed", err.Error())
+		return
+	}
+
+	sessionID := fmt.Sprintf("job-%d", job.ID)
+	var script strings.Builder
+	for _, step := range spec.Steps {
+		for k, v := range step.Env {
+			fmt.Fprintf(&script, "export %s=%q\n", k, v)
+		}
+		for _, cmd := range step.Commands {
+			script.WriteString(cmd)
+			script.WriteString("\n")
+		}
+	}
+
+	workerID := strconv.FormatUint(uint64(worker.ID), 10)
+
+	var session *Session
+	var err error
+	if workerconn.Connected(workerID) {
+		session, err = a.sessions.CreateRemote(sessionID, workerID)
+		if err == nil {
+			// Exec attaches to an interactive shell, not a one-shot bash -c
+			// like the local branch, so it never exits on its own: tell it
+			// to exit explicitly once the script is done.
+			err = session.WriteInput([]byte(script.String() + "\nexit $?\n"))
+		}
+	} else {
+		session, err = a.sessions.Create(sessionID, exec.Command("bash", "-c", script.String()))
+	}
+	if err != nil {
+		a.finishJob(job, worker, "failed", err.Error())
+		return
+	}
+
+	ch := make(chan []byte, 256)
+	var output strings.Builder
+	output.Write(session.subscribe(ch))
+	for b := range ch {
+		output.Write(b)
+	}
+
+	a.finishJob(job, worker, "done", output.String())
+}
+
+func (a *WorkerAPI) finishJob(job store.Job, worker store.Worker, status, output string) {
+	a.db.Model(&job).Update("status", status)
+	a.db.Create(&store.Build{JobID: job.ID, Output: output, Status: status})
+	a.pool.SetStatus(worker.ID, "idle")
+}
@@ -0,0 +1,180 @@
+// Package pool manages the lifecycle of DigitalOcean droplets used as
+// build workers: creating, listing, tag-filtering and destroying them,
+// with state persisted through worker/store.
+package pool
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/digitalocean/godo"
+	"gorm.io/gorm"
+
+	"kiwi/worker/store"
+)
+
+// CreateRequest selects the shape of a new worker droplet.
+type CreateRequest struct {
+	Region string
+	Size   string
+	Image  string
+	Env    string
+}
+
+// Pool creates and tracks worker droplets through a DigitalOcean client,
+// persisting their state in db.
+type Pool struct {
+	client *godo.Client
+	db     *gorm.DB
+}
+
+// New returns a Pool backed by client and db.
+func New(client *godo.Client, db *gorm.DB) *Pool {
+	return &Pool{client: client, db: db}
+}
+
+// defaultTags returns the tag set every pool-managed droplet gets.
+// CreateRequest has no way to override it.
+func defaultTags(env string) []string {
+	return []string{"kiwi", "worker", "env:" + env}
+}
+
+// Create provisions a new droplet per req and persists a Worker row for
+// it with status "provisioning". A random token is minted for the
+// worker and passed to the droplet as boot-time user data, so its agent
+// can present it when registering its tunnel.
+func (p *Pool) Create(ctx context.Context, req CreateRequest) (*store.Worker, error) {
+	tags := defaultTags(req.Env)
+
+	token, err := newToken()
+	if err != nil {
+		return nil, fmt.Errorf("generate worker token: %w", err)
+	}
+
+	droplet, _, err := p.client.Droplets.Create(ctx, &godo.DropletCreateRequest{
+		Name:     fmt.Sprintf("kiwi-worker-%s", req.Env),
+		Region:   req.Region,
+		Size:     req.Size,
+		Image:    godo.DropletCreateImage{Slug: req.Image},
+		Tags:     tags,
+		UserData: fmt.Sprintf("#!/bin/bash\nexport KIWI_WORKER_TOKEN=%s\n", token),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create droplet: %w", err)
+	}
+
+	w := &store.Worker{
+		DropletID: int64(droplet.ID),
+		Name:      droplet.Name,
+		Region:    req.Region,
+		Size:      req.Size,
+		Image:     req.Image,
+		Tags:      strings.Join(tags, ","),
+		Status:    "provisioning",
+		Token:     token,
+	}
+	if err := p.db.Create(w).Error; err != nil {
+		return nil, fmt.Errorf("persist worker: %w", err)
+	}
+
+	return w, nil
+}
+
+// newToken returns a random hex-encoded secret suitable for a worker to
+// authenticate its tunnel registration with.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// List returns all tracked workers, optionally filtered to those carrying
+// tag.
+func (p *Pool) List(tag string) ([]store.Worker, error) {
+	var workers []store.Worker
+	q := p.db.Model(&store.Worker{})
+	if tag != "" {
+		q = q.Where("',' || tags || ',' LIKE ?", "%,"+tag+",%")
+	}
+	if err := q.Find(&workers).Error; err != nil {
+		return nil, err
+	}
+	return workers, nil
+}
+
+// Idle returns the first idle worker carrying tag, if any.
+func (p *Pool) Idle(tag string) (*store.Worker, error) {
+	var w store.Worker
+	q := p.db.Where("status = ?", "idle")
+	if tag != "" {
+		q = q.Where("',' || tags || ',' LIKE ?", "%,"+tag+",%")
+	}
+	err := q.First(&w).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// VerifyToken reports whether token matches the one minted for worker id
+// at creation time, so only the droplet it was handed to (or whoever
+// else holds it) can register a tunnel under that worker's ID.
+func (p *Pool) VerifyToken(id uint, token string) bool {
+	var w store.Worker
+	if err := p.db.First(&w, id).Error; err != nil {
+		return false
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(w.Token), []byte(token)) == 1
+}
+
+// PollProvisioning checks every worker still marked "provisioning"
+// against the DigitalOcean API and flips it to "idle" once its droplet
+// reports active, so the scheduler can start assigning jobs to it.
+func (p *Pool) PollProvisioning(ctx context.Context) error {
+	var workers []store.Worker
+	if err := p.db.Where("status = ?", "provisioning").Find(&workers).Error; err != nil {
+		return fmt.Errorf("list provisioning workers: %w", err)
+	}
+
+	for _, w := range workers {
+		droplet, _, err := p.client.Droplets.Get(ctx, int(w.DropletID))
+		if err != nil {
+			continue
+		}
+		if droplet.Status == "active" {
+			if err := p.SetStatus(w.ID, "idle"); err != nil {
+				return fmt.Errorf("mark worker %d idle: %w", w.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetStatus updates a worker's status column.
+func (p *Pool) SetStatus(id uint, status string) error {
+	return p.db.Model(&store.Worker{}).Where("id = ?", id).Update("status", status).Error
+}
+
+// Destroy deletes the droplet backing worker id and marks it destroyed.
+func (p *Pool) Destroy(ctx context.Context, id uint) error {
+	var w store.Worker
+	if err := p.db.First(&w, id).Error; err != nil {
+		return fmt.Errorf("find worker: %w", err)
+	}
+
+	if _, err := p.client.Droplets.Delete(ctx, int(w.DropletID)); err != nil {
+		return fmt.Errorf("delete droplet: %w", err)
+	}
+
+	return p.db.Model(&w).Update("status", "destroyed").Error
+}
@@ -0,0 +1,53 @@
+// Package store holds the gorm models and DB handle used to persist
+// workers, jobs and builds in test.db.
+package store
+
+import (
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Worker is a provisioned DigitalOcean droplet tracked by the pool.
+type Worker struct {
+	gorm.Model
+	DropletID int64
+	Name      string
+	Region    string
+	Size      string
+	Image     string
+	Tags      string // comma-separated, e.g. "kiwi,worker,env:prod"
+	Status    string // "provisioning", "idle", "busy", "destroyed"
+	Token     string `json:"-"` // shared secret the droplet presents to register its tunnel
+}
+
+// Job is one queued or completed run of a YAML pipeline spec.
+type Job struct {
+	gorm.Model
+	WorkerID *uint
+	Spec     string // the raw YAML pipeline document
+	Status   string // "queued", "running", "done", "failed"
+}
+
+// Build is the output and result of a Job having been run on a Worker.
+type Build struct {
+	gorm.Model
+	JobID    uint
+	Output   string
+	ExitCode int
+	Status   string // "done", "failed"
+}
+
+// Open opens (creating if necessary) the sqlite database at path and
+// migrates the Worker, Job and Build tables.
+func Open(path string) (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.AutoMigrate(&Worker{}, &Job{}, &Build{}); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
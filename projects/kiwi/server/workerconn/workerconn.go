@@ -0,0 +1,134 @@
+// Package workerconn implements the control-plane side of the reverse
+// tunnel: worker droplets dial in over a websocket, the server
+// multiplexes logical streams over that one connection with yamux, and
+// the rest of the codebase dials out to a worker as if it were just
+// another local process.
+package workerconn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/yamux"
+)
+
+// registry tracks the yamux session backing each worker's tunnel.
+type registry struct {
+	mu       sync.Mutex
+	sessions map[string]*yamux.Session
+}
+
+var defaultRegistry = &registry{sessions: make(map[string]*yamux.Session)}
+
+// Register adopts conn (the server side of a worker's tunnel connection)
+// as workerID's multiplexed session, replacing any previous one for that
+// worker.
+func Register(workerID string, conn net.Conn) error {
+	session, err := yamux.Server(conn, yamux.DefaultConfig())
+	if err != nil {
+		return fmt.Errorf("yamux server for %s: %w", workerID, err)
+	}
+
+	defaultRegistry.mu.Lock()
+	if old, ok := defaultRegistry.sessions[workerID]; ok {
+		old.Close()
+	}
+	defaultRegistry.sessions[workerID] = session
+	defaultRegistry.mu.Unlock()
+
+	go func() {
+		<-session.CloseChan()
+		defaultRegistry.mu.Lock()
+		if defaultRegistry.sessions[workerID] == session {
+			delete(defaultRegistry.sessions, workerID)
+		}
+		defaultRegistry.mu.Unlock()
+	}()
+
+	return nil
+}
+
+// Connected reports whether workerID currently has a live tunnel.
+func Connected(workerID string) bool {
+	defaultRegistry.mu.Lock()
+	defer defaultRegistry.mu.Unlock()
+	_, ok := defaultRegistry.sessions[workerID]
+	return ok
+}
+
+// Stream operations sent as the first byte of every logical stream, so
+// the worker agent knows what to do with it without having to infer
+// intent from an address string.
+const (
+	opDial byte = iota // proxy the stream to network/addr on the worker
+	opExec             // spawn a shell on the worker and attach it to the stream
+)
+
+// openStream opens a new logical stream to workerID over its tunnel
+// session.
+func openStream(workerID string) (net.Conn, error) {
+	defaultRegistry.mu.Lock()
+	session, ok := defaultRegistry.sessions[workerID]
+	defaultRegistry.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("worker %s not connected", workerID)
+	}
+
+	stream, err := session.Open()
+	if err != nil {
+		return nil, fmt.Errorf("open stream to %s: %w", workerID, err)
+	}
+	return stream, nil
+}
+
+// Dial opens a new logical stream to workerID and asks its tunnel agent
+// to proxy it to network/addr, then hands back the stream as a net.Conn
+// so callers can port-forward an arbitrary port on the worker exactly
+// like a local one, e.g. a debug HTTP server.
+func Dial(workerID, network, addr string) (net.Conn, error) {
+	stream, err := openStream(workerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeDialHeader(stream, network, addr); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// Exec opens a new logical stream to workerID and asks its tunnel agent
+// to spawn a shell and attach it to the stream, so callers can drive a
+// remote session the same way they'd drive a local process.
+func Exec(workerID string) (net.Conn, error) {
+	stream, err := openStream(workerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := stream.Write([]byte{opExec}); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// writeDialHeader sends the worker agent an opDial request identifying
+// the network/addr the new stream should be proxied to.
+func writeDialHeader(conn net.Conn, network, addr string) error {
+	if _, err := conn.Write([]byte{opDial}); err != nil {
+		return err
+	}
+
+	header := []byte(network + " " + addr)
+	if err := binary.Write(conn, binary.BigEndian, uint16(len(header))); err != nil {
+		return err
+	}
+	_, err := conn.Write(header)
+	return err
+}
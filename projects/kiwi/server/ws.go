@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame types used on the /sessions/{id}/ws full-duplex connection. Each
+// websocket message is a single type byte followed by its payload.
+const (
+	frameStdout byte = iota
+	frameStdin
+	frameResize
+)
+
+var upgrader = websocket.Upgrader{
+	// The SSE endpoints already do CORS this permissively.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsHandler upgrades /sessions/{id}/ws to a websocket carrying both stdout
+// frames and stdin/resize frames over one full-duplex connection, for
+// clients that can't use the unidirectional SSE endpoint plus separate
+// input/resize POSTs.
+func (m *SessionManager) wsHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := m.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("ws upgrade: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ch := make(chan []byte, 256)
+	backlog := s.subscribe(ch)
+	id := r.PathValue("id")
+	defer s.unsubscribe(ch, func() { m.Terminate(id) })
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if len(backlog) > 0 {
+			if err := conn.WriteMessage(websocket.BinaryMessage, append([]byte{frameStdout}, backlog...)); err != nil {
+				return
+			}
+		}
+		for {
+			select {
+			case b, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := conn.WriteMessage(websocket.BinaryMessage, append([]byte{frameStdout}, b...)); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if len(msg) == 0 {
+			continue
+		}
+
+		switch msg[0] {
+		case frameStdin:
+			s.WriteInput(msg[1:])
+		case frameResize:
+			if len(msg) < 5 {
+				continue
+			}
+			rows := binary.BigEndian.Uint16(msg[1:3])
+			cols := binary.BigEndian.Uint16(msg[3:5])
+			s.Resize(rows, cols)
+		}
+	}
+
+	close(stop)
+	<-done
+}